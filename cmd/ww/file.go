@@ -7,18 +7,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"webwormhole.io/wormhole"
 )
 
 const (
 	// msgChunkSize is the maximum size of a WebRTC DataChannel message.
-	// 64k is okay for most modern browsers, 32 is conservative.
-	msgChunkSize = 32 << 10
+	msgChunkSize = wormhole.MaxMessageSize
 )
 
 type header struct {
-	Name string `json:"name",omitempty`
-	Size int    `json:"size",omitempty`
-	Type string `json:"type",omitempty`
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Type string `json:"type"`
 }
 
 func receive(args ...string) {
@@ -31,6 +32,7 @@ func receive(args ...string) {
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
 	directory := set.String("dir", ".", "directory to put downloaded files")
+	force := set.Bool("force", false, "overwrite existing files")
 	set.Parse(args[1:])
 
 	if set.NArg() > 1 {
@@ -57,11 +59,24 @@ func receive(args ...string) {
 			fatalf("could not decode file header: %v", err)
 		}
 
-		f, err := os.Create(filepath.Join(*directory, filepath.Clean(h.Name)))
+		// The name comes from the peer, so only ever use its last element
+		// to keep the file inside directory.
+		name := filepath.Base(filepath.Clean(h.Name))
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			fatalf("refusing to save file with invalid name %q", h.Name)
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if *force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(filepath.Join(*directory, name), flags, 0666)
+		if os.IsExist(err) {
+			fatalf("%s already exists, use -force to overwrite it", name)
+		}
 		if err != nil {
-			fatalf("could not create output file %s: %v", h.Name, err)
+			fatalf("could not create output file %s: %v", name, err)
 		}
-		fmt.Fprintf(set.Output(), "receiving %v... ", h.Name)
+		fmt.Fprintf(set.Output(), "receiving %v... ", name)
 		written, err := io.CopyBuffer(f, io.LimitReader(c, int64(h.Size)), make([]byte, msgChunkSize))
 		if err != nil {
 			fatalf("\ncould not save file: %v", err)
@@ -85,6 +100,7 @@ func send(args ...string) {
 	}
 	length := set.Int("length", 2, "length of generated secret")
 	code := set.String("code", "", "use a wormhole code instead of generating one")
+	confirm := set.Bool("confirm", false, "wait for enter after checking the fingerprint before sending")
 	set.Parse(args[1:])
 
 	if set.NArg() < 1 {
@@ -92,6 +108,9 @@ func send(args ...string) {
 		os.Exit(2)
 	}
 	c := newConn(*code, *length)
+	if *confirm {
+		confirmFingerprint()
+	}
 
 	for _, filename := range set.Args() {
 		f, err := os.Open(filename)
@@ -124,5 +143,5 @@ func send(args ...string) {
 		f.Close()
 		fmt.Fprintf(set.Output(), "done\n")
 	}
-	c.Close()
+	closeConn(c)
 }
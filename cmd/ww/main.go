@@ -5,13 +5,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	crand "crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"rsc.io/qr"
 	"webwormhole.io/wordlist"
@@ -26,8 +31,10 @@ var subcmds = map[string]func(args ...string){
 }
 
 var (
-	verbose bool   = false
-	sigserv string = "https://webwormhole.io"
+	verbose bool          = false
+	sigserv string        = "https://webwormhole.io"
+	timeout time.Duration = 0
+	policy  string        = "all"
 )
 
 var stderr = flag.CommandLine.Output()
@@ -42,11 +49,14 @@ func usage() {
 	}
 	fmt.Fprintf(stderr, "\nflags:\n")
 	flag.PrintDefaults()
+	fmt.Fprintf(stderr, "\nexit status is %d if the peer may not have received all data.\n", exitUnflushed)
 }
 
 func main() {
 	flag.BoolVar(&verbose, "verbose", LookupEnvOrBool("WW_VERBOSE", verbose), "verbose logging")
 	flag.StringVar(&sigserv, "signal", LookupEnvOrString("WW_SIGSERV", sigserv), "signalling server to use")
+	flag.DurationVar(&timeout, "timeout", LookupEnvOrDuration("WW_TIMEOUT", timeout), "give up if not connected within this long (0 waits for a peer as long as the server allows, then 30s for webrtc)")
+	flag.StringVar(&policy, "ice-policy", LookupEnvOrString("WW_ICE_POLICY", policy), "ice candidates to use: all, or relay to hide our address from the peer")
 	flag.Usage = usage
 	flag.Parse()
 	if flag.NArg() < 1 {
@@ -56,6 +66,13 @@ func main() {
 	if verbose {
 		wormhole.Verbose = true
 	}
+	switch policy {
+	case "all":
+	case "relay":
+		wormhole.RelayOnly = true
+	default:
+		fatalf("unknown ice policy: %v", policy)
+	}
 	cmd, ok := subcmds[flag.Arg(0)]
 	if !ok {
 		flag.Usage()
@@ -69,15 +86,34 @@ func fatalf(format string, v ...interface{}) {
 	os.Exit(1)
 }
 
+// exitUnflushed is the exit status when the connection closed before the
+// peer got everything we sent, so scripts can tell it from other failures.
+const exitUnflushed = 3
+
+// closeConn closes c, exiting with exitUnflushed if data was left unsent.
+func closeConn(c *wormhole.Wormhole) {
+	if errors.Is(c.Close(), wormhole.ErrUnflushed) {
+		fmt.Fprintf(stderr, "peer did not receive all data before closing\n")
+		os.Exit(exitUnflushed)
+	}
+}
+
 func newConn(code string, length int) *wormhole.Wormhole {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	if code != "" {
 		// Join wormhole.
+		code = parseCode(code)
 		slot, pass := wordlist.Decode(code)
 		if pass == nil {
 			fatalf("could not decode password")
 		}
-		c, err := wormhole.Join(strconv.Itoa(slot), string(pass), sigserv)
-		if err == wormhole.ErrBadVersion {
+		c, err := wormhole.Join(ctx, strconv.Itoa(slot), string(pass), sigserv)
+		if errors.Is(err, wormhole.ErrBadVersion) {
 			fatalf(
 				"%s%s%s",
 				"the signalling server is running an incompatable version.\n",
@@ -88,11 +124,7 @@ func newConn(code string, length int) *wormhole.Wormhole {
 		if err != nil {
 			fatalf("could not dial: %v", err)
 		}
-		if c.IsRelay() {
-			fmt.Fprintf(stderr, "connected: relay\n")
-		} else {
-			fmt.Fprintf(stderr, "connected: direct\n")
-		}
+		printconnected(c)
 		return c
 	}
 	// New wormhole.
@@ -109,8 +141,8 @@ func newConn(code string, length int) *wormhole.Wormhole {
 		}
 		printcode(wordlist.Encode(slot, pass))
 	}()
-	c, err := wormhole.New(string(pass), sigserv, slotc)
-	if err == wormhole.ErrBadVersion {
+	c, err := wormhole.New(ctx, string(pass), sigserv, slotc)
+	if errors.Is(err, wormhole.ErrBadVersion) {
 		fatalf(
 			"%s%s%s",
 			"the signalling server is running an incompatable version.\n",
@@ -121,12 +153,49 @@ func newConn(code string, length int) *wormhole.Wormhole {
 	if err != nil {
 		fatalf("could not dial: %v", err)
 	}
+	printconnected(c)
+	return c
+}
+
+// printconnected reports how we connected, and the key fingerprint in the
+// same form the web client shows it, so both sides can compare them.
+func printconnected(c *wormhole.Wormhole) {
 	if c.IsRelay() {
 		fmt.Fprintf(stderr, "connected: relay\n")
 	} else {
 		fmt.Fprintf(stderr, "connected: direct\n")
 	}
-	return c
+	fp := wordlist.Encode(0, c.Fingerprint()[1:])
+	fmt.Fprintf(stderr, "fingerprint: %s\n", fp[strings.Index(fp, "-")+1:])
+}
+
+// confirmFingerprint waits for the user to press enter once they have
+// compared the fingerprint with their peer. It reads from the terminal
+// rather than stdin, since pipe sends stdin.
+func confirmFingerprint() {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		fatalf("could not open terminal to confirm: %v", err)
+	}
+	defer tty.Close()
+	fmt.Fprintf(stderr, "press enter if the fingerprint matches your peer's, ctrl-c otherwise\n")
+	if _, err := bufio.NewReader(tty).ReadString('\n'); err != nil {
+		fatalf("could not read confirmation: %v", err)
+	}
+}
+
+// parseCode returns the wormhole code from code, which is either a bare
+// code or a link like the one printcode prints. For a link, it also uses
+// the link's signalling server, since that is where the slot lives.
+func parseCode(code string) string {
+	u, err := url.Parse(code)
+	if err != nil || u.Fragment == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return code
+	}
+	code = u.Fragment
+	u.Fragment = ""
+	sigserv = u.String()
+	return code
 }
 
 func printcode(code string) {
@@ -186,6 +255,17 @@ func LookupEnvOrBool(key string, defaultVal bool) bool {
 	return defaultVal
 }
 
+func LookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		val, err := time.ParseDuration(v)
+		if err != nil {
+			fatalf("Cannot parse envvar: %s: %v", v, err)
+		}
+		return val
+	}
+	return defaultVal
+}
+
 func LookupEnvOrString(key string, defaultVal string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
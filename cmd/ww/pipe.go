@@ -1,12 +1,47 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"webwormhole.io/wormhole"
 )
 
+// interruptDrain bounds how long pipe waits for buffered data to reach the
+// peer after an interrupt, instead of the usual wormhole.CloseTimeout.
+const interruptDrain = 2 * time.Second
+
+var errStopped = errors.New("pipe stopped")
+
+// stopWriter passes writes through to w until stopc is closed. After that,
+// new writes fail with errStopped, and so does one already in progress
+// whatever its own error, since the connection is being closed under it.
+type stopWriter struct {
+	w     io.Writer
+	stopc chan struct{}
+}
+
+func (s *stopWriter) Write(p []byte) (int, error) {
+	select {
+	case <-s.stopc:
+		return 0, errStopped
+	default:
+	}
+	n, err := s.w.Write(p)
+	select {
+	case <-s.stopc:
+		return n, errStopped
+	default:
+	}
+	return n, err
+}
+
 func pipe(args ...string) {
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
@@ -16,6 +51,7 @@ func pipe(args ...string) {
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
+	confirm := set.Bool("confirm", false, "wait for enter after checking the fingerprint before piping")
 	set.Parse(args[1:])
 
 	if set.NArg() > 1 {
@@ -23,24 +59,57 @@ func pipe(args ...string) {
 		os.Exit(2)
 	}
 	c := newConn(set.Arg(0), *length)
+	if *confirm {
+		confirmFingerprint()
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintf(stderr, "reading from terminal, end input with ctrl-d\n")
+	}
+
+	// Close the connection cleanly on interrupt so the peer sees EOF
+	// instead of waiting for ICE to time out.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 
 	done := make(chan struct{})
 	// The recieve end of the pipe.
 	go func() {
 		_, err := io.CopyBuffer(os.Stdout, c, make([]byte, msgChunkSize))
+		// A clean close by the peer is io.EOF, which CopyBuffer swallows.
+		if errors.Is(err, wormhole.ErrConnFailed) {
+			fatalf("lost connection to peer: %v", err)
+		}
 		if err != nil {
 			fatalf("could not write to stdout: %v", err)
 		}
 		done <- struct{}{}
 	}()
 	// The send end of the pipe.
+	w := &stopWriter{w: c, stopc: make(chan struct{})}
 	go func() {
-		_, err := io.CopyBuffer(c, os.Stdin, make([]byte, msgChunkSize))
+		_, err := io.CopyBuffer(w, os.Stdin, make([]byte, msgChunkSize))
+		if err == errStopped {
+			return
+		}
+		if errors.Is(err, wormhole.ErrConnFailed) {
+			fatalf("lost connection to peer: %v", err)
+		}
 		if err != nil {
 			fatalf("could not write to channel: %v", err)
 		}
 		done <- struct{}{}
 	}()
-	<-done
-	c.Close()
+	select {
+	case <-done:
+	case sig := <-sigc:
+		// Let a second interrupt kill us if closing takes too long.
+		signal.Stop(sigc)
+		close(w.stopc)
+		wormhole.CloseTimeout = interruptDrain
+		closeConn(c)
+		// Stdin was cut short, so don't report success. Exit like the shell
+		// does for a process killed by sig.
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}
+	closeConn(c)
 }
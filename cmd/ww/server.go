@@ -182,8 +182,8 @@ func relay(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
 
 	initmsg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
+		Slot       string             `json:"slot"`
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
 	}{}
 	initmsg.ICEServers = append(turnServers(), stunServers...)
 
@@ -37,10 +37,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"filippo.io/cpace"
@@ -99,20 +102,65 @@ var (
 	// version of the signalling protocol.
 	ErrBadVersion = errors.New("bad version")
 
-	// ErrBadVersion is returned when the the peer on the same slot uses a different
+	// ErrBadKey is returned when the the peer on the same slot uses a different
 	// password.
 	ErrBadKey = errors.New("bad key")
 
 	// ErrNoSuchSlot indicates no one is on the slot requested.
 	ErrNoSuchSlot = errors.New("no such slot")
 
+	// ErrNoMoreSlots indicates the signalling server could not allocate a slot.
+	ErrNoMoreSlots = errors.New("no more slots")
+
+	// ErrPeerHungUp indicates the peer closed its connection to the signalling
+	// server before the handshake finished.
+	ErrPeerHungUp = errors.New("peer hung up")
+
 	// ErrTimedOut indicates signalling has timed out.
 	ErrTimedOut = errors.New("timed out")
+
+	// ErrConnFailed indicates the WebRTC connection to the peer failed, for
+	// example because ICE could not find a working candidate pair. Read and
+	// Write return it, instead of io.EOF, once an open connection fails.
+	ErrConnFailed = errors.New("webrtc connection failed")
+
+	// ErrBadMessage indicates the signalling server relayed a message that is not
+	// in the expected encoding, which points at a broken or incompatible server
+	// rather than the peer. Errors wrapping it quote the start of the message.
+	ErrBadMessage = errors.New("bad message from signalling server")
+
+	// ErrBadPeerMessage indicates a message decrypted fine, so it came from the
+	// peer, but was not what the protocol expects, e.g. an empty offer. This
+	// points at an incompatible peer.
+	ErrBadPeerMessage = errors.New("bad message from peer")
+
+	// ErrUnflushed is returned by Close when buffered data could not be sent
+	// before the connection was closed.
+	ErrUnflushed = errors.New("could not flush all data")
+
+	// ErrNoRelay is returned when RelayOnly is set but the signalling server
+	// offered no TURN servers.
+	ErrNoRelay = errors.New("relay-only requested but no turn servers offered")
+
+	// ErrBadSignallingURL is returned when the signalling server address is not
+	// an absolute http, https, ws, or wss URL.
+	ErrBadSignallingURL = errors.New("bad signalling server url")
 )
 
+// MaxMessageSize is the largest DataChannel message Write sends. Larger
+// writes are split up. 64 KiB is okay for most peers, 32 KiB is conservative.
+const MaxMessageSize = 32 << 10
+
+// CloseTimeout is how long Close waits for buffered data to be sent.
+var CloseTimeout = 30 * time.Second
+
 // Verbose logging.
 var Verbose = false
 
+// RelayOnly restricts ICE to TURN relay candidates, so the peer only ever
+// learns the relay's address and not ours. Only the TURN server sees ours.
+var RelayOnly = false
+
 func logf(format string, v ...interface{}) {
 	if Verbose {
 		log.Printf(format, v...)
@@ -132,48 +180,91 @@ type Wormhole struct {
 	// opened signals that the underlying DataChannel is open and ready
 	// to handle data.
 	opened chan struct{}
-	// err forwards errors from the OnError callback.
+	// err forwards the first error from the OnError callback, or from
+	// detaching the channel, to the handshake.
 	err chan error
 	// flushc is a condition variable to coordinate flushed state of the
 	// underlying channel.
 	flushc *sync.Cond
+	// fingerprint is derived from the PAKE key. See Fingerprint.
+	fingerprint []byte
+	// failed is set to 1 when the PeerConnection fails, so Read and Write
+	// can tell an abort from the peer closing the channel.
+	failed int32
 }
 
-// Read writes a message to the default DataChannel.
+// Write writes p to the default DataChannel, splitting it into messages of
+// at most MaxMessageSize bytes.
 func (c *Wormhole) Write(p []byte) (n int, err error) {
-	// The webrtc package's channel does not have a blocking Write, so
-	// we can't just use io.Copy until the issue is fixed upsteam.
-	// Work around this by blocking here and waiting for flushes.
-	// https://github.com/pion/sctp/issues/77
-	c.flushc.L.Lock()
-	for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() {
-		c.flushc.Wait()
+	for len(p) > 0 {
+		msg := p
+		if len(msg) > MaxMessageSize {
+			msg = msg[:MaxMessageSize]
+		}
+		// The webrtc package's channel does not have a blocking Write, so
+		// we can't just use io.Copy until the issue is fixed upsteam.
+		// Work around this by blocking here and waiting for flushes.
+		// https://github.com/pion/sctp/issues/77
+		c.flushc.L.Lock()
+		for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() &&
+			c.d.ReadyState() == webrtc.DataChannelStateOpen {
+			c.flushc.Wait()
+		}
+		c.flushc.L.Unlock()
+		m, err := c.rwc.Write(msg)
+		n += m
+		if err != nil {
+			if atomic.LoadInt32(&c.failed) == 1 {
+				err = ErrConnFailed
+			}
+			return n, err
+		}
+		p = p[m:]
 	}
-	c.flushc.L.Unlock()
-	return c.rwc.Write(p)
+	return n, nil
 }
 
-// Read read a message from the default DataChannel.
+// Read read a message from the default DataChannel. It returns io.EOF when
+// the peer closes the channel, and ErrConnFailed if the connection failed.
 func (c *Wormhole) Read(p []byte) (n int, err error) {
-	return c.rwc.Read(p)
+	n, err = c.rwc.Read(p)
+	// Closing a failed PeerConnection ends the stream with a plain io.EOF.
+	if err == io.EOF && atomic.LoadInt32(&c.failed) == 1 {
+		err = ErrConnFailed
+	}
+	return n, err
 }
 
 // TODO benchmark this buffer madness.
 func (c *Wormhole) flushed() {
 	c.flushc.L.Lock()
-	c.flushc.Signal()
+	c.flushc.Broadcast()
 	c.flushc.L.Unlock()
 }
 
 // Close attempts to flush the DataChannel buffers then close it
-// and its PeerConnection.
+// and its PeerConnection. It returns ErrUnflushed if the buffers did
+// not drain within CloseTimeout.
 func (c *Wormhole) Close() (err error) {
 	logf("closing")
-	for c.d.BufferedAmount() != 0 {
-		// SetBufferedAmountLowThreshold does not seem to take effect
-		// when after the last Write().
-		time.Sleep(time.Second) // eww.
+	// OnBufferedAmountLow only fires when the buffered amount crosses the
+	// threshold, so drop it to zero to get notified once everything is sent.
+	// Give up if the peer stops acknowledging data, rather than wait forever.
+	c.flushc.L.Lock()
+	c.d.SetBufferedAmountLowThreshold(0)
+	timedout := false
+	timer := time.AfterFunc(CloseTimeout, func() {
+		c.flushc.L.Lock()
+		timedout = true
+		c.flushc.Broadcast()
+		c.flushc.L.Unlock()
+	})
+	for c.d.BufferedAmount() != 0 && c.d.ReadyState() == webrtc.DataChannelStateOpen && !timedout {
+		c.flushc.Wait()
 	}
+	unflushed := c.d.BufferedAmount() != 0
+	c.flushc.L.Unlock()
+	timer.Stop()
 	tryclose := func(c io.Closer) {
 		e := c.Close()
 		if e != nil {
@@ -183,6 +274,9 @@ func (c *Wormhole) Close() (err error) {
 	defer tryclose(c.pc)
 	defer tryclose(c.d)
 	defer tryclose(c.rwc)
+	if unflushed {
+		return ErrUnflushed
+	}
 	return nil
 }
 
@@ -190,26 +284,74 @@ func (c *Wormhole) open() {
 	var err error
 	c.rwc, err = c.d.Detach()
 	if err != nil {
-		c.err <- err
+		c.error(err)
 		return
 	}
 	close(c.opened)
 }
 
+// stateChange tears down the PeerConnection if it fails, e.g. because the
+// remote peer went away, so that any blocked Reads and Writes return
+// ErrConnFailed.
+func (c *Wormhole) stateChange(s webrtc.PeerConnectionState) {
+	logf("peer connection state: %v", s)
+	switch s {
+	case webrtc.PeerConnectionStateFailed:
+		// Unblocks New or Join if we're still in the handshake.
+		c.error(ErrConnFailed)
+		atomic.StoreInt32(&c.failed, 1)
+		c.pc.Close()
+	case webrtc.PeerConnectionStateClosed:
+		c.flushc.L.Lock()
+		c.flushc.Broadcast()
+		c.flushc.L.Unlock()
+	}
+}
+
 // It's not really clear to me when this will be invoked.
 func (c *Wormhole) error(err error) {
-	log.Printf("debug: %v", err)
-	c.err <- err
+	logf("datachannel error: %v", err)
+	// Only the handshake reads c.err, and only the first error matters to
+	// it. Never block the callback on later ones.
+	select {
+	case c.err <- err:
+	default:
+	}
 }
 
-func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
-	_, buf, err := ws.Read(context.TODO())
+// closeErr translates the WebSocket close statuses used by the signalling
+// server into this package's errors. Other errors are returned as is.
+func closeErr(err error) error {
+	switch websocket.CloseStatus(err) {
+	case CloseNoSuchSlot:
+		return ErrNoSuchSlot
+	case CloseSlotTimedOut:
+		return ErrTimedOut
+	case CloseNoMoreSlots:
+		return ErrNoMoreSlots
+	case CloseWrongProto:
+		return ErrBadVersion
+	case ClosePeerHungUp:
+		return ErrPeerHungUp
+	case CloseBadKey:
+		return ErrBadKey
+	}
+	return err
+}
+
+func readEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v interface{}) error {
+	_, buf, err := ws.Read(ctx)
 	if err != nil {
-		return err
+		return closeErr(err)
 	}
 	encrypted, err := base64.URLEncoding.DecodeString(string(buf))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v (%.32q)", ErrBadMessage, err, buf)
+	}
+	// Anything shorter than a nonce and an empty box can't have come from
+	// the peer, so don't blame its key.
+	if len(encrypted) < 24+secretbox.Overhead {
+		return fmt.Errorf("%w: too short (%.32q)", ErrBadMessage, buf)
 	}
 	var nonce [24]byte
 	copy(nonce[:], encrypted[:24])
@@ -217,10 +359,13 @@ func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	if !ok {
 		return ErrBadKey
 	}
-	return json.Unmarshal(jsonmsg, v)
+	if err := json.Unmarshal(jsonmsg, v); err != nil {
+		return fmt.Errorf("%w: %v (%.32q)", ErrBadPeerMessage, err, jsonmsg)
+	}
+	return nil
 }
 
-func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+func writeEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	jsonmsg, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -230,7 +375,7 @@ func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 		return err
 	}
 	return ws.Write(
-		context.TODO(),
+		ctx,
 		websocket.MessageText,
 		[]byte(base64.URLEncoding.EncodeToString(
 			secretbox.Seal(nonce[:], jsonmsg, &nonce, key),
@@ -238,46 +383,86 @@ func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	)
 }
 
-func readBase64(ws *websocket.Conn) ([]byte, error) {
-	_, buf, err := ws.Read(context.TODO())
+func readBase64(ctx context.Context, ws *websocket.Conn) ([]byte, error) {
+	_, buf, err := ws.Read(ctx)
 	if err != nil {
-		return nil, err
+		return nil, closeErr(err)
+	}
+	p, err := base64.URLEncoding.DecodeString(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v (%.32q)", ErrBadMessage, err, buf)
 	}
-	return base64.URLEncoding.DecodeString(string(buf))
+	return p, nil
 }
 
-func writeBase64(ws *websocket.Conn, p []byte) error {
+func writeBase64(ctx context.Context, ws *websocket.Conn, p []byte) error {
 	return ws.Write(
-		context.TODO(),
+		ctx,
 		websocket.MessageText,
 		[]byte(base64.URLEncoding.EncodeToString(p)),
 	)
 }
 
+// checkSDP returns an error wrapping ErrBadPeerMessage unless sd is a
+// non-empty session description of type want.
+func checkSDP(sd webrtc.SessionDescription, want webrtc.SDPType) error {
+	if sd.Type != want || sd.SDP == "" {
+		return fmt.Errorf("%w: want %v, got %v with %d bytes of sdp", ErrBadPeerMessage, want, sd.Type, len(sd.SDP))
+	}
+	return nil
+}
+
+// wsURL returns the WebSocket address of slot on signalling server sigserv.
+// An empty slot asks the server to allocate a new one.
+func wsURL(sigserv, slot string) (string, error) {
+	u, err := url.Parse(sigserv)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", ErrBadSignallingURL
+	}
+	if u.Host == "" {
+		return "", ErrBadSignallingURL
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.Path += slot
+	return u.String(), nil
+}
+
 // readInitMsg reads the first message the signalling server sends over
 // the WebSocket connection, which has metadata includign assigned slot
 // and ICE servers to use.
-func readInitMsg(ws *websocket.Conn) (slot string, iceServers []webrtc.ICEServer, err error) {
+func readInitMsg(ctx context.Context, ws *websocket.Conn) (slot string, iceServers []webrtc.ICEServer, err error) {
 	msg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
+		Slot       string             `json:"slot"`
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
 	}{}
 
-	_, buf, err := ws.Read(context.TODO())
+	_, buf, err := ws.Read(ctx)
 	if err != nil {
-		return "", nil, err
+		return "", nil, closeErr(err)
 	}
-	err = json.Unmarshal(buf, &msg)
-	return msg.Slot, msg.ICEServers, err
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		return "", nil, fmt.Errorf("%w: %v (%.32q)", ErrBadMessage, err, buf)
+	}
+	return msg.Slot, msg.ICEServers, nil
 }
 
 // handleRemoteCandidates waits for remote candidate to trickle in. We close
 // the websocket when we get a successful connection so this should fail and
 // exit at some point.
-func (c *Wormhole) handleRemoteCandidates(ws *websocket.Conn, key *[32]byte) {
+func (c *Wormhole) handleRemoteCandidates(ctx context.Context, ws *websocket.Conn, key *[32]byte) {
 	for {
 		var candidate webrtc.ICECandidateInit
-		err := readEncJSON(ws, key, &candidate)
+		err := readEncJSON(ctx, ws, key, &candidate)
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 			return
 		}
@@ -294,6 +479,18 @@ func (c *Wormhole) handleRemoteCandidates(ws *websocket.Conn, key *[32]byte) {
 	}
 }
 
+// hasTURN reports whether any of ice is a TURN server.
+func hasTURN(ice []webrtc.ICEServer) bool {
+	for _, s := range ice {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) error {
 	// Accessing pion/webrtc APIs like DataChannel.Detach() requires
 	// that we do this voodoo.
@@ -302,14 +499,31 @@ func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) error {
 	s.SetICEProxyDialer(proxy.FromEnvironment())
 	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(s))
 
-	var err error
-	c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{
+	conf := webrtc.Configuration{
 		ICEServers: ice,
-	})
+	}
+	if RelayOnly {
+		if !hasTURN(ice) {
+			return ErrNoRelay
+		}
+		conf.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	var err error
+	c.pc, err = rtcapi.NewPeerConnection(conf)
 	if err != nil {
 		return err
 	}
 
+	c.pc.OnConnectionStateChange(c.stateChange)
+	c.pc.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		logf("ice connection state: %v", s)
+	})
+	c.pc.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(
+		func(pair *webrtc.ICECandidatePair) {
+			logf("selected candidate pair: %v", pair)
+		},
+	)
+
 	sigh := true
 	c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
 		Negotiated: &sigh,
@@ -327,6 +541,32 @@ func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) error {
 	return nil
 }
 
+// closeOnError tears down the PeerConnection if a handshake failed
+// part way through.
+func (c *Wormhole) closeOnError(err *error) {
+	if *err == nil || c.pc == nil {
+		return
+	}
+	if e := c.pc.Close(); e != nil {
+		logf("cannot close peer connection: %v", e)
+	}
+}
+
+// fingerprint derives a short value from the PAKE key for peers to compare.
+// It is computed the same way as in the web client.
+func fingerprint(key *[32]byte) ([]byte, error) {
+	fp := make([]byte, 8)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("fingerprint")), fp)
+	return fp, err
+}
+
+// Fingerprint returns a value derived from the PAKE key, which is the same
+// on both peers. Comparing it out of band detects the unlikely case of a
+// MITM that guessed the password.
+func (c *Wormhole) Fingerprint() []byte {
+	return c.fingerprint
+}
+
 // IsRelay returns whether this connection is over a TURN relay or not.
 func (c *Wormhole) IsRelay() bool {
 	stats := c.pc.GetStats()
@@ -354,6 +594,16 @@ func (c *Wormhole) IsRelay() bool {
 	return false
 }
 
+// connectTimeout returns a channel that fires once the default limit on
+// establishing the WebRTC connection is up, or nil if ctx has a deadline of
+// its own to go by instead.
+func connectTimeout(ctx context.Context) <-chan time.Time {
+	if _, ok := ctx.Deadline(); ok {
+		return nil
+	}
+	return time.After(30 * time.Second)
+}
+
 // New starts a new signalling handshake after asking the server to allocate
 // a new slot.
 //
@@ -363,49 +613,55 @@ func (c *Wormhole) IsRelay() bool {
 //
 // The server generated slot identifier is written on slotc.
 //
-// If pc is nil it initialises ones using the default STUN server.
-func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
-	c := &Wormhole{
+// The handshake is aborted if ctx is cancelled or expires before the
+// WebRTC connection is established. If ctx has no deadline, establishing the
+// WebRTC connection after signalling gives up with ErrTimedOut after 30s.
+func New(ctx context.Context, pass string, sigserv string, slotc chan string) (c *Wormhole, err error) {
+	c = &Wormhole{
 		opened: make(chan struct{}),
-		err:    make(chan error),
+		err:    make(chan error, 1),
 		flushc: sync.NewCond(&sync.Mutex{}),
 	}
+	defer c.closeOnError(&err)
 
-	u, err := url.Parse(sigserv)
+	wsaddr, err := wsURL(sigserv, "")
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme == "http" || u.Scheme == "ws" {
-		u.Scheme = "ws"
-	} else {
-		u.Scheme = "wss"
-	}
-	wsaddr := u.String()
 
-	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
+	ws, _, err := websocket.Dial(ctx, wsaddr, &websocket.DialOptions{
 		Subprotocols: []string{Protocol},
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("connecting to signalling server: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			// Let the server and the peer know we've given up.
+			ws.Close(websocket.StatusNormalClosure, "")
+		}
+	}()
 
-	assignedSlot, iceServers, err := readInitMsg(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
-	}
+	assignedSlot, iceServers, err := readInitMsg(ctx, ws)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("connecting to signalling server: %w", err)
 	}
 	logf("connected to signalling server, got slot: %v", assignedSlot)
-	slotc <- assignedSlot
+	// Set up the peer connection before handing out the slot, so that
+	// something like ErrNoRelay fails before anyone tries to join.
 	err = c.newPeerConnection(iceServers)
 	if err != nil {
 		return nil, err
 	}
+	select {
+	case slotc <- assignedSlot:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for peer: %w", ctx.Err())
+	}
 
-	msgA, err := readBase64(ws)
+	msgA, err := readBase64(ctx, ws)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("waiting for peer: %w", err)
 	}
 	logf("got A pake msg (%v bytes)", len(msgA))
 
@@ -418,7 +674,11 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = writeBase64(ws, msgB)
+	c.fingerprint, err = fingerprint(&key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeBase64(ctx, ws, msgB)
 	if err != nil {
 		return nil, err
 	}
@@ -428,7 +688,7 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 		if candidate == nil {
 			return
 		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
+		err := writeEncJSON(ctx, ws, &key, candidate.ToJSON())
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 			return
 		}
@@ -443,7 +703,7 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = writeEncJSON(ws, &key, offer)
+	err = writeEncJSON(ctx, ws, &key, offer)
 	if err != nil {
 		return nil, err
 	}
@@ -454,12 +714,12 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 	logf("sent offer")
 
 	var answer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &answer)
-	if websocket.CloseStatus(err) == CloseBadKey {
-		return nil, ErrBadKey
+	err = readEncJSON(ctx, ws, &key, &answer)
+	if err == nil {
+		err = checkSDP(answer, webrtc.SDPTypeAnswer)
 	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("waiting for answer: %w", err)
 	}
 	err = c.pc.SetRemoteDescription(answer)
 	if err != nil {
@@ -467,7 +727,7 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 	}
 	logf("got answer")
 
-	go c.handleRemoteCandidates(ws, &key)
+	go c.handleRemoteCandidates(ctx, ws, &key)
 
 	select {
 	case <-c.opened:
@@ -479,9 +739,13 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 			ws.Close(CloseWebRTCSuccessDirect, "")
 		}
 	case err = <-c.err:
+		err = fmt.Errorf("establishing webrtc connection: %w", err)
 		ws.Close(CloseWebRTCFailed, "")
-	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
+	case <-ctx.Done():
+		err = fmt.Errorf("establishing webrtc connection: %w", ctx.Err())
+		ws.Close(CloseWebRTCFailed, "cancelled")
+	case <-connectTimeout(ctx):
+		err = fmt.Errorf("establishing webrtc connection: %w", ErrTimedOut)
 		ws.Close(CloseWebRTCFailed, "timed out")
 	}
 	return c, err
@@ -493,40 +757,39 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 // sigserv, and pass is used as the PAKE password authenticate the WebRTC
 // offer and answer.
 //
-// If pc is nil it initialises ones using the default STUN server.
-func Join(slot, pass string, sigserv string) (*Wormhole, error) {
-	c := &Wormhole{
+// The handshake is aborted if ctx is cancelled or expires before the
+// WebRTC connection is established. If ctx has no deadline, establishing the
+// WebRTC connection after signalling gives up with ErrTimedOut after 30s.
+func Join(ctx context.Context, slot, pass string, sigserv string) (c *Wormhole, err error) {
+	c = &Wormhole{
 		opened: make(chan struct{}),
-		err:    make(chan error),
+		err:    make(chan error, 1),
 		flushc: sync.NewCond(&sync.Mutex{}),
 	}
+	defer c.closeOnError(&err)
 
-	u, err := url.Parse(sigserv)
+	wsaddr, err := wsURL(sigserv, slot)
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme == "http" || u.Scheme == "ws" {
-		u.Scheme = "ws"
-	} else {
-		u.Scheme = "wss"
-	}
-	u.Path += slot
-	wsaddr := u.String()
 
 	// Start the handshake.
-	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
+	ws, _, err := websocket.Dial(ctx, wsaddr, &websocket.DialOptions{
 		Subprotocols: []string{Protocol},
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("connecting to signalling server: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			// Let the server and the peer know we've given up.
+			ws.Close(websocket.StatusNormalClosure, "")
+		}
+	}()
 
-	_, iceServers, err := readInitMsg(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
-	}
+	_, iceServers, err := readInitMsg(ctx, ws)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("connecting to signalling server: %w", err)
 	}
 	logf("connected to signalling server on slot: %v", slot)
 	err = c.newPeerConnection(iceServers)
@@ -548,18 +811,15 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = writeBase64(ws, msgA)
+	err = writeBase64(ctx, ws, msgA)
 	if err != nil {
 		return nil, err
 	}
 	logf("sent A pake msg (%v bytes)", len(msgA))
 
-	msgB, err := readBase64(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
-	}
+	msgB, err := readBase64(ctx, ws)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("waiting for peer: %w", err)
 	}
 	mk, err := pake.Finish(msgB)
 	if err != nil {
@@ -570,24 +830,30 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.fingerprint, err = fingerprint(&key)
+	if err != nil {
+		return nil, err
+	}
 	logf("have key, got B msg (%v bytes)", len(msgB))
 
 	var offer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &offer)
-	if err == ErrBadKey {
+	err = readEncJSON(ctx, ws, &key, &offer)
+	if errors.Is(err, ErrBadKey) {
 		// Close with the right status so the other side knows to quit immediately.
 		ws.Close(CloseBadKey, "bad key")
-		return nil, err
+	}
+	if err == nil {
+		err = checkSDP(offer, webrtc.SDPTypeOffer)
 	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("waiting for offer: %w", err)
 	}
 
 	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil {
 			return
 		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
+		err := writeEncJSON(ctx, ws, &key, candidate.ToJSON())
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 			return
 		}
@@ -607,7 +873,7 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = writeEncJSON(ws, &key, answer)
+	err = writeEncJSON(ctx, ws, &key, answer)
 	if err != nil {
 		return nil, err
 	}
@@ -617,7 +883,7 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 	}
 	logf("sent answer")
 
-	go c.handleRemoteCandidates(ws, &key)
+	go c.handleRemoteCandidates(ctx, ws, &key)
 
 	select {
 	case <-c.opened:
@@ -629,9 +895,13 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 			ws.Close(CloseWebRTCSuccessDirect, "")
 		}
 	case err = <-c.err:
+		err = fmt.Errorf("establishing webrtc connection: %w", err)
 		ws.Close(CloseWebRTCFailed, "")
-	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
+	case <-ctx.Done():
+		err = fmt.Errorf("establishing webrtc connection: %w", ctx.Err())
+		ws.Close(CloseWebRTCFailed, "cancelled")
+	case <-connectTimeout(ctx):
+		err = fmt.Errorf("establishing webrtc connection: %w", ErrTimedOut)
 		ws.Close(CloseWebRTCFailed, "timed out")
 	}
 	return c, err
@@ -0,0 +1,474 @@
+package wormhole
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/crypto/nacl/secretbox"
+	"nhooyr.io/websocket"
+)
+
+// testRelay is a minimal in-memory signalling server. Like the one in
+// cmd/ww it hands out slots and pipes two WebSockets together, but it
+// sends no ICE servers, so peers only use host candidates.
+type testRelay struct {
+	sync.Mutex
+	next  int
+	slots map[string]chan *websocket.Conn
+}
+
+func newTestRelay() *httptest.Server {
+	return httptest.NewServer(&testRelay{slots: make(map[string]chan *websocket.Conn)})
+}
+
+// relayMsg is one read from a relayed WebSocket.
+type relayMsg struct {
+	typ websocket.MessageType
+	p   []byte
+	err error
+}
+
+func (r *testRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+		Subprotocols: []string{Protocol},
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	ctx := req.Context()
+
+	// Keep reading while we wait for the other side, so we answer close
+	// frames and notice when a client gives up on its slot.
+	msgs := make(chan relayMsg)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			typ, p, err := conn.Read(ctx)
+			select {
+			case msgs <- relayMsg{typ, p, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	slot := strings.TrimPrefix(req.URL.Path, "/")
+	var rconn *websocket.Conn
+	if slot == "" {
+		r.Lock()
+		r.next++
+		slot = strconv.Itoa(r.next)
+		sc := make(chan *websocket.Conn)
+		r.slots[slot] = sc
+		r.Unlock()
+		if conn.Write(ctx, websocket.MessageText, []byte(`{"slot":"`+slot+`"}`)) != nil {
+			return
+		}
+		select {
+		case sc <- conn:
+			rconn = <-sc
+		case <-msgs:
+			// Gave up (or misbehaved) before anyone joined.
+			r.Lock()
+			if r.slots[slot] == sc {
+				delete(r.slots, slot)
+			}
+			r.Unlock()
+			close(sc)
+			return
+		}
+	} else {
+		r.Lock()
+		sc, ok := r.slots[slot]
+		delete(r.slots, slot)
+		r.Unlock()
+		if !ok {
+			conn.Close(CloseNoSuchSlot, "no such slot")
+			return
+		}
+		if conn.Write(ctx, websocket.MessageText, []byte(`{"slot":"`+slot+`"}`)) != nil {
+			return
+		}
+		select {
+		case rconn, ok = <-sc:
+			if !ok {
+				conn.Close(ClosePeerHungUp, "peer hung up")
+				return
+			}
+		case <-msgs:
+			return
+		}
+		sc <- conn
+	}
+
+	for m := range msgs {
+		// Same as the real server: any close other than a WebRTC result tells
+		// the peer we hung up.
+		switch websocket.CloseStatus(m.err) {
+		case CloseBadKey:
+			rconn.Close(CloseBadKey, "bad key")
+			return
+		case CloseWebRTCFailed, CloseWebRTCSuccess, CloseWebRTCSuccessDirect, CloseWebRTCSuccessRelay:
+			return
+		}
+		if m.err != nil {
+			rconn.Close(ClosePeerHungUp, "peer hung up")
+			return
+		}
+		if rconn.Write(ctx, m.typ, m.p) != nil {
+			return
+		}
+	}
+}
+
+func TestWSURL(t *testing.T) {
+	cases := []struct {
+		sigserv string
+		slot    string
+		url     string
+		err     error
+	}{
+		{"https://webwormhole.io", "", "wss://webwormhole.io/", nil},
+		{"https://webwormhole.io/", "42", "wss://webwormhole.io/42", nil},
+		{"http://localhost:8000", "42", "ws://localhost:8000/42", nil},
+		{"wss://example.com/ww", "42", "wss://example.com/ww/42", nil},
+		{"ws://example.com/ww/", "42", "ws://example.com/ww/42", nil},
+		{"webwormhole.io", "42", "", ErrBadSignallingURL},
+		{"ftp://webwormhole.io", "42", "", ErrBadSignallingURL},
+		{"https://", "42", "", ErrBadSignallingURL},
+	}
+	for i, c := range cases {
+		if u, err := wsURL(c.sigserv, c.slot); u != c.url || err != c.err {
+			t.Errorf("testcase %v (%v) got %v,%v want %v,%v", i, c.sigserv, u, err, c.url, c.err)
+		}
+	}
+}
+
+func TestReadBadMessage(t *testing.T) {
+	cases := []string{
+		"not base64!",
+		base64.URLEncoding.EncodeToString([]byte("short")),
+		// Long enough for a nonce, but not for a sealed box.
+		base64.URLEncoding.EncodeToString(bytes.Repeat([]byte{'x'}, 30)),
+	}
+	for i, msg := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+			conn.Write(r.Context(), websocket.MessageText, []byte(msg))
+			conn.Read(r.Context())
+		}))
+		ctx := context.Background()
+		ws, _, err := websocket.Dial(ctx, srv.URL, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		var v interface{}
+		if err := readEncJSON(ctx, ws, &[32]byte{}, &v); !errors.Is(err, ErrBadMessage) {
+			t.Errorf("testcase %v got %v want %v", i, err, ErrBadMessage)
+		}
+		ws.Close(websocket.StatusNormalClosure, "")
+		srv.Close()
+	}
+}
+
+func TestReadBadPeerMessage(t *testing.T) {
+	// Sealed with the right key, so it can only have come from the peer.
+	var key [32]byte
+	var nonce [24]byte
+	msg := base64.URLEncoding.EncodeToString(secretbox.Seal(nonce[:], []byte("not json"), &nonce, &key))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		conn.Write(r.Context(), websocket.MessageText, []byte(msg))
+		conn.Read(r.Context())
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	ws, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	var v interface{}
+	if err := readEncJSON(ctx, ws, &key, &v); !errors.Is(err, ErrBadPeerMessage) {
+		t.Errorf("got %v want %v", err, ErrBadPeerMessage)
+	}
+}
+
+func TestCheckSDP(t *testing.T) {
+	cases := []struct {
+		sd   webrtc.SessionDescription
+		want webrtc.SDPType
+		ok   bool
+	}{
+		{webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}, webrtc.SDPTypeOffer, true},
+		{webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0"}, webrtc.SDPTypeOffer, false},
+		{webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer}, webrtc.SDPTypeAnswer, false},
+		{webrtc.SessionDescription{SDP: "v=0"}, webrtc.SDPTypeAnswer, false},
+	}
+	for i, c := range cases {
+		err := checkSDP(c.sd, c.want)
+		if c.ok && err != nil || !c.ok && !errors.Is(err, ErrBadPeerMessage) {
+			t.Errorf("testcase %v got %v", i, err)
+		}
+	}
+}
+
+// dialPair runs New and Join against sigserv with the given passwords.
+func dialPair(ctx context.Context, sigserv, passA, passB string) (a, b *Wormhole, errA, errB error) {
+	slotc := make(chan string)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case slot := <-slotc:
+			b, errB = Join(ctx, slot, passB, sigserv)
+		case <-stop:
+		}
+	}()
+	a, errA = New(ctx, passA, sigserv, slotc)
+	// New may fail before it hands out a slot.
+	close(stop)
+	<-done
+	return a, b, errA, errB
+}
+
+func TestHandshake(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	a, b, errA, errB := dialPair(ctx, sigserv.URL, "pass", "pass")
+	if errA != nil || errB != nil {
+		t.Fatalf("handshake failed: new: %v, join: %v", errA, errB)
+	}
+
+	if fa, fb := a.Fingerprint(), b.Fingerprint(); len(fa) == 0 || !bytes.Equal(fa, fb) {
+		t.Errorf("fingerprints %x and %x do not match", fa, fb)
+	}
+
+	msg := []byte("hello, world")
+	if _, err := a.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 1<<10)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := string(buf[:n]); got != string(msg) {
+		t.Errorf("got %q want %q", got, msg)
+	}
+
+	// Writes larger than a single message get split up.
+	big := bytes.Repeat([]byte{'x'}, 3*MaxMessageSize+1)
+	if n, err := a.Write(big); n != len(big) || err != nil {
+		t.Fatalf("write: %v,%v want %v,nil", n, err, len(big))
+	}
+	got := make([]byte, len(big))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("large write corrupted")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestConnFailed(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	a, b, errA, errB := dialPair(ctx, sigserv.URL, "pass", "pass")
+	if errA != nil || errB != nil {
+		t.Fatalf("handshake failed: new: %v, join: %v", errA, errB)
+	}
+	defer b.Close()
+
+	readc := make(chan error)
+	go func() {
+		_, err := a.Read(make([]byte, 1<<10))
+		readc <- err
+	}()
+	// Give the Read a moment to block before the connection fails under it.
+	time.Sleep(100 * time.Millisecond)
+	a.stateChange(webrtc.PeerConnectionStateFailed)
+	select {
+	case err := <-readc:
+		if err != ErrConnFailed {
+			t.Errorf("read: got %v want %v", err, ErrConnFailed)
+		}
+	case <-ctx.Done():
+		t.Fatalf("read still blocked after failure")
+	}
+	if _, err := a.Write([]byte("hello")); err != ErrConnFailed {
+		t.Errorf("write: got %v want %v", err, ErrConnFailed)
+	}
+}
+
+func TestHandshakeBadKey(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, _, errA, errB := dialPair(ctx, sigserv.URL, "pass", "wrong")
+	if !errors.Is(errA, ErrBadKey) || !errors.Is(errB, ErrBadKey) {
+		t.Errorf("got new: %v, join: %v want %v", errA, errB, ErrBadKey)
+	}
+}
+
+func TestJoinNoSuchSlot(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := Join(ctx, "42", "pass", sigserv.URL); !errors.Is(err, ErrNoSuchSlot) {
+		t.Errorf("got %v want %v", err, ErrNoSuchSlot)
+	}
+}
+
+func TestNewCancel(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Cancel while New waits for someone to join the slot.
+	slotc := make(chan string)
+	go func() {
+		<-slotc
+		cancel()
+	}()
+	if _, err := New(ctx, "pass", sigserv.URL, slotc); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v want %v", err, context.Canceled)
+	}
+}
+
+func TestJoinHangUp(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Join the slot and give up straight after the init message, the way
+	// Join does when it fails partway through the handshake.
+	slotc := make(chan string)
+	go func() {
+		u, err := wsURL(sigserv.URL, <-slotc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ws, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+			Subprotocols: []string{Protocol},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, _, err := readInitMsg(ctx, ws); err != nil {
+			t.Error(err)
+		}
+		ws.Close(websocket.StatusNormalClosure, "")
+	}()
+	if _, err := New(ctx, "pass", sigserv.URL, slotc); !errors.Is(err, ErrPeerHungUp) {
+		t.Errorf("got %v want %v", err, ErrPeerHungUp)
+	}
+}
+
+func TestRelayOnly(t *testing.T) {
+	RelayOnly = true
+	defer func() { RelayOnly = false }()
+
+	cases := []struct {
+		ice  []webrtc.ICEServer
+		want error
+	}{
+		{nil, ErrNoRelay},
+		{[]webrtc.ICEServer{{URLs: []string{"stun:stun.example.com"}}}, ErrNoRelay},
+		{[]webrtc.ICEServer{{URLs: []string{"turn:turn.example.com"}, Username: "u", Credential: "p"}}, nil},
+	}
+	for i, tc := range cases {
+		c := &Wormhole{
+			opened: make(chan struct{}),
+			err:    make(chan error, 1),
+			flushc: sync.NewCond(&sync.Mutex{}),
+		}
+		err := c.newPeerConnection(tc.ice)
+		if err != tc.want {
+			t.Errorf("testcase %v got %v want %v", i, err, tc.want)
+		}
+		if err == nil {
+			if p := c.pc.GetConfiguration().ICETransportPolicy; p != webrtc.ICETransportPolicyRelay {
+				t.Errorf("testcase %v got policy %v want %v", i, p, webrtc.ICETransportPolicyRelay)
+			}
+			c.pc.Close()
+		}
+	}
+}
+
+func TestNewRelayOnlyNoTURN(t *testing.T) {
+	sigserv := newTestRelay()
+	defer sigserv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	RelayOnly = true
+	defer func() { RelayOnly = false }()
+	// The test relay offers no ICE servers at all, so New must fail before
+	// handing out a slot nobody could use.
+	slotc := make(chan string, 1)
+	if _, err := New(ctx, "pass", sigserv.URL, slotc); !errors.Is(err, ErrNoRelay) {
+		t.Errorf("got %v want %v", err, ErrNoRelay)
+	}
+	select {
+	case slot := <-slotc:
+		t.Errorf("got slot %v before failing", slot)
+	default:
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	if connectTimeout(context.Background()) == nil {
+		t.Errorf("no default limit without a deadline")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if connectTimeout(ctx) != nil {
+		t.Errorf("default limit overrides the context's deadline")
+	}
+}